@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestParseEgressUpstreams(t *testing.T) {
+	upstreams, err := parseEgressUpstreams("user:pw@host1:1080,host2:1080,DIRECT")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(upstreams) != 3 {
+		t.Fatalf("expected 3 upstreams, got %d", len(upstreams))
+	}
+
+	u1 := upstreams[0]
+	if u1.addr != "host1:1080" || u1.user != "user" || u1.pass != "pw" {
+		t.Errorf("upstream 0 = %+v, want addr=host1:1080 user=user pass=pw", u1)
+	}
+
+	u2 := upstreams[1]
+	if u2.addr != "host2:1080" || u2.user != "" || u2.pass != "" {
+		t.Errorf("upstream 1 = %+v, want addr=host2:1080 with no credentials", u2)
+	}
+
+	u3 := upstreams[2]
+	if !u3.isDirect() {
+		t.Errorf("upstream 2 should be the DIRECT pseudo-entry")
+	}
+
+	if _, err := parseEgressUpstreams(""); err == nil {
+		t.Errorf("expected error for a spec with no usable entries")
+	}
+}
+
+func TestHistogramObserve(t *testing.T) {
+	h := newHistogram([]float64{0.1, 0.5, 1})
+	h.observe(0.05)
+	h.observe(0.3)
+	h.observe(0.3)
+	h.observe(5)
+
+	if h.count != 4 {
+		t.Fatalf("expected count 4, got %d", h.count)
+	}
+	if h.counts[0] != 1 {
+		t.Errorf("le=0.1 bucket: expected 1, got %d", h.counts[0])
+	}
+	if h.counts[1] != 3 {
+		t.Errorf("le=0.5 bucket: expected 3, got %d", h.counts[1])
+	}
+	if h.counts[2] != 3 {
+		t.Errorf("le=1 bucket: expected 3, got %d", h.counts[2])
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	cases := []struct {
+		in      string
+		low     uint32
+		high    uint32
+		wantErr bool
+	}{
+		{"1-1024", 1, 1024, false},
+		{"80-80", 80, 80, false},
+		{"0-100", 0, 0, true},   // low of 0 is invalid
+		{"100-50", 0, 0, true},  // high < low
+		{"abc-100", 0, 0, true}, // non-numeric
+		{"100", 0, 0, true},     // missing "-high"
+	}
+	for _, c := range cases {
+		low, high, err := parsePortRange(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parsePortRange(%q): expected error, got low=%d high=%d", c.in, low, high)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePortRange(%q): unexpected error: %v", c.in, err)
+			continue
+		}
+		if low != c.low || high != c.high {
+			t.Errorf("parsePortRange(%q) = %d, %d; want %d, %d", c.in, low, high, c.low, c.high)
+		}
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := parsePortRanges("80,443,1024-65535")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ranges.contains(80) || !ranges.contains(443) || !ranges.contains(2222) {
+		t.Errorf("expected 80, 443 and 2222 to be contained, got %+v", ranges)
+	}
+	if ranges.contains(81) {
+		t.Errorf("81 should not be contained, got %+v", ranges)
+	}
+
+	empty, err := parsePortRanges("")
+	if err != nil {
+		t.Fatalf("unexpected error for empty spec: %v", err)
+	}
+	if empty.contains(80) {
+		t.Errorf("empty port range list should not contain anything")
+	}
+
+	if _, err := parsePortRanges("not-a-port"); err == nil {
+		t.Errorf("expected error for malformed spec")
+	}
+}
+
+func TestPortPolicyAllowsPrecedence(t *testing.T) {
+	p, err := newPortPolicy("80,443", "443", `\.internal$`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !p.allows("example.com", 80) {
+		t.Errorf("port 80 should be allowed")
+	}
+	if p.allows("example.com", 443) {
+		t.Errorf("deny list should win over allow list for port 443")
+	}
+	if p.allows("example.com", 8080) {
+		t.Errorf("ports outside a non-empty allow list should be denied")
+	}
+	if p.allows("host.internal", 80) {
+		t.Errorf("denyHostsRegex should reject host.internal regardless of port")
+	}
+
+	anyPort, err := newPortPolicy("", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !anyPort.allows("example.com", 9999) {
+		t.Errorf("an empty allow list with no deny rules should allow any port")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestQuotaTrackerExceeded(t *testing.T) {
+	var q *quotaTracker
+	if q.exceeded() {
+		t.Errorf("a nil tracker should never report exceeded")
+	}
+	q.add(100) // must not panic on a nil receiver
+
+	unlimited := &quotaTracker{limitBytes: 0}
+	unlimited.add(1 << 20)
+	if unlimited.exceeded() {
+		t.Errorf("limitBytes <= 0 should mean unlimited")
+	}
+
+	limited := &quotaTracker{limitBytes: 10}
+	if limited.exceeded() {
+		t.Errorf("tracker should not be exceeded before any usage is added")
+	}
+	limited.add(9)
+	if limited.exceeded() {
+		t.Errorf("usage below the limit should not be exceeded")
+	}
+	limited.add(1)
+	if !limited.exceeded() {
+		t.Errorf("usage at the limit should be exceeded")
+	}
+}
+
+// TestQuotaCopyStopsAfterExceeding exercises the known quirk documented on
+// quotaTracker: quotaCopy only checks quota.exceeded() at the top of its
+// loop, so a single Read/Write that straddles the limit is allowed to
+// complete in full before the next iteration catches it and returns
+// errQuotaExceeded.
+func TestQuotaCopyStopsAfterExceeding(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 10 * time.Millisecond})
+	defer rdb.Close()
+
+	quota := &quotaTracker{limitBytes: 10}
+	src := bytes.NewReader(make([]byte, 20))
+	var dst bytes.Buffer
+
+	total, err := quotaCopy(rdb, nil, "testuser", "test", quota, nil, &dst, src)
+	if err != errQuotaExceeded {
+		t.Fatalf("expected errQuotaExceeded, got %v", err)
+	}
+	if total != 20 {
+		t.Errorf("expected the in-flight write to complete before the next check caught it, got total=%d", total)
+	}
+	if dst.Len() != 20 {
+		t.Errorf("expected all 20 bytes to reach dst, got %d", dst.Len())
+	}
+}